@@ -21,23 +21,16 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/html"
 
-	"github.com/dongsupark/go-subtitle/pkg"
 	"github.com/dongsupark/go-subtitle/subtitle"
 )
 
-const (
-	SamiStateInit      = 0
-	SamiStateSyncStart = 1
-	SamiStateText      = 2
-	SamiStateSyncEnd   = 3
-	SamiStateForceQuit = 99
-)
-
 var textElemTags = []string{
 	"i",
 	"b",
@@ -67,51 +60,317 @@ func hasLegitElemTag(input string) bool {
 	return false
 }
 
-type SamiStateType int
+// isRawTextTag reports whether data is an html.Node.Data value for a
+// raw-text element, whose children must be written out verbatim rather than
+// escaped. Sami nodes built by this package (e.g. the STYLE node built by
+// buildStyleNode) stuff their attributes straight into Data, e.g.
+// "STYLE Type=text/css", so only the leading tag name is checked.
+func isRawTextTag(data string) bool {
+	name := data
+	if i := strings.IndexAny(data, " \t"); i >= 0 {
+		name = data[:i]
+	}
+	switch strings.ToLower(name) {
+	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "xmp":
+		return true
+	}
+	return false
+}
+
+// defaultSamiClass is the P Class used for entries that don't carry an
+// explicit class: ReadTracks groups them under it, and Write emits it on
+// their <P>, whether or not the SamiFormat has any Styles set.
+const defaultSamiClass = "ENCC"
+
+// SamiStyle holds the subset of a SAMI <STYLE> block's per-language P.xxx
+// declaration that this package understands.
+type SamiStyle struct {
+	ClassName string
+	Lang      string
+	Name      string
+	Alignment string
+	Color     string
+	FontSize  string
+}
 
 type SamiFormat struct {
 	TypeName string
+
+	// Styles holds the per-language P classes declared in the file's
+	// <STYLE> block, keyed by upper-cased ClassName. Read populates it;
+	// Write emits it back as a <STYLE> block and tags each entry's <P>
+	// with its ClassName.
+	Styles map[string]*SamiStyle
+
+	// RawStyle holds the verbatim CSS text found inside the <STYLE>
+	// block, exactly as read, including comments and media queries that
+	// parseSamiStyles doesn't otherwise understand.
+	RawStyle string
+
+	// TimeBase is the unit that SYNC Start values are counted in. It
+	// defaults to time.Millisecond, per the SAMI spec; set it to
+	// time.Second or a TTML-style 100ns tick for frame-accurate authoring
+	// in other units.
+	TimeBase time.Duration
 }
 
-func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
-	var st subtitle.Subtitle
+// samiStyleRuleRe matches a single CSS rule selecting a SAMI P class, e.g.
+// "P.ENCC { lang: en-US; name: English; }" or ".ENCC { ... }".
+var samiStyleRuleRe = regexp.MustCompile(`(?is)(?:p\s*)?\.([A-Za-z0-9_-]+)\s*\{([^}]*)\}`)
+
+// samiDeclRe matches a single "key: value" CSS declaration.
+var samiDeclRe = regexp.MustCompile(`([a-zA-Z-]+)\s*:\s*([^;]+)`)
+
+// samiAtRuleRe matches a CSS at-rule block such as @media or @font-face,
+// including one level of brace nesting (enough for @media's nested rule
+// bodies). parseSamiStyles strips these before scanning for P.xxx rules, so
+// a rule nested inside an @media block doesn't get mistaken for, and
+// clobber, a real top-level declaration for the same class.
+var samiAtRuleRe = regexp.MustCompile(`(?is)@[a-zA-Z-]+[^{}]*\{(?:[^{}]*\{[^{}]*\})*[^{}]*\}`)
+
+// parseSamiStyles parses the CSS found inside a SAMI <STYLE> block into a
+// map of SamiStyle keyed by upper-cased class name.
+func parseSamiStyles(cssText string) map[string]*SamiStyle {
+	cssText = samiAtRuleRe.ReplaceAllString(cssText, "")
+
+	styles := make(map[string]*SamiStyle)
+
+	for _, rule := range samiStyleRuleRe.FindAllStringSubmatch(cssText, -1) {
+		className := rule[1]
+		style := &SamiStyle{ClassName: className}
+
+		for _, decl := range samiDeclRe.FindAllStringSubmatch(rule[2], -1) {
+			key := strings.ToLower(strings.TrimSpace(decl[1]))
+			val := strings.TrimSpace(decl[2])
+
+			switch key {
+			case "lang":
+				style.Lang = val
+			case "name":
+				style.Name = val
+			case "text-align":
+				style.Alignment = val
+			case "color":
+				style.Color = val
+			case "font-size":
+				style.FontSize = val
+			}
+		}
+
+		styles[strings.ToUpper(className)] = style
+	}
+
+	return styles
+}
+
+// samiRawTextTags are the elements whose body is raw text (CDATA-like) per
+// the HTML spec: everything up to the matching end tag is opaque and must
+// never be fed through parseStartTagToken/parseTextToken, or stray '<', '>'
+// and "</p>"-looking substrings inside it (e.g. in a CSS rule or comment)
+// confuse the SAMI state machine.
+var samiRawTextTags = map[string]bool{
+	"style":    true,
+	"script":   true,
+	"title":    true,
+	"textarea": true,
+}
+
+// readSamiRawTextElement consumes tokens up to and including the closing
+// tag matching tagName and returns the raw text found in between. The
+// underlying html.Tokenizer already treats style/script/title/textarea as
+// raw text by default (see its internal rawTag handling), which is why
+// their whole body arrives as a single TextToken here; there's no need to
+// call z.NextIsNotRawText(), since that method exists to suppress raw-text
+// mode and would just reopen the bug this fixes.
+func readSamiRawTextElement(z *html.Tokenizer, tagName string) (string, error) {
+	var raw strings.Builder
+
+	for {
+		tok := z.Next()
+		switch tok {
+		case html.TextToken:
+			raw.Write(z.Text())
+		case html.EndTagToken:
+			tn, _ := z.TagName()
+			if strings.ToLower(string(tn)) == tagName {
+				return raw.String(), nil
+			}
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return raw.String(), nil
+			}
+			return "", fmt.Errorf("sami: unterminated <%s> block: %v", strings.ToUpper(tagName), z.Err())
+		}
+	}
+}
+
+// buildStyleNode renders sr.Styles back into a <STYLE> element, in
+// ascending class-name order so Write output is deterministic.
+func (sr *SamiFormat) buildStyleNode() *html.Node {
+	names := make([]string, 0, len(sr.Styles))
+	for name := range sr.Styles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var css strings.Builder
+	css.WriteString("\n")
+	for _, name := range names {
+		st := sr.Styles[name]
+		css.WriteString(fmt.Sprintf("P.%s { ", name))
+		if st.Lang != "" {
+			css.WriteString(fmt.Sprintf("lang: %s; ", st.Lang))
+		}
+		if st.Name != "" {
+			css.WriteString(fmt.Sprintf("name: %s; ", st.Name))
+		}
+		if st.Alignment != "" {
+			css.WriteString(fmt.Sprintf("text-align: %s; ", st.Alignment))
+		}
+		if st.Color != "" {
+			css.WriteString(fmt.Sprintf("color: %s; ", st.Color))
+		}
+		if st.FontSize != "" {
+			css.WriteString(fmt.Sprintf("font-size: %s; ", st.FontSize))
+		}
+		css.WriteString("}\n")
+	}
+
+	// samiRender never emits closing tags, but <STYLE> is a raw-text
+	// element: without an explicit terminator, a reader (ours or a real
+	// player) would swallow the rest of the document as CSS. Write the
+	// closing tag as part of the element's own text content instead.
+	css.WriteString("</STYLE>\n")
+
+	styleNode := &html.Node{
+		Type: html.ElementNode,
+		Data: "STYLE Type=text/css",
+	}
+	styleNode.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: css.String(),
+	})
+	return styleNode
+}
+
+// parseSamiEntries tokenizes a SAMI document into a flat slice of entries,
+// each tagged with the Class found on its <P> element. An entry is appended
+// when it is closed (by the next P of its class, or at the end of the
+// document), so each class's entries are in document order, while entries
+// of different classes follow the order in which they were closed. As
+// a side effect it populates sr.Styles from any <STYLE> block encountered.
+// Read and ReadTracks are both built on top of this.
+func (sr *SamiFormat) parseSamiEntries(inputData string) ([]subtitle.SubtitleEntry, error) {
+	var entries []subtitle.SubtitleEntry
+
+	// pending holds, per P Class, the entry that class last opened with
+	// real text and hasn't yet been closed by a later &nbsp; (or
+	// superseded by a later piece of text). A SYNC block commonly carries
+	// one P per class, but a multi-track document merged onto a shared
+	// timeline (see WriteTracks) can carry several P's under one SYNC, so
+	// every class needs its own independently tracked open entry rather
+	// than a single shared one.
+	pending := make(map[string]*subtitle.SubtitleEntry)
+	lastStartByClass := make(map[string]time.Duration)
+
 	se := new(subtitle.SubtitleEntry)
-	samiState := SamiStateType(SamiStateInit)
-	prevStartValue := time.Duration(0)
+	seStarted := false // se has accumulated real (non-&nbsp;) text
+	seIsBlank := false // se's only text so far is an &nbsp; clear marker
+	currentTs := time.Duration(0)
 
 	inputData = strings.TrimSpace(inputData)
 
 	renl := regexp.MustCompile("\\n")
 
-	storeGetNewSubEntry := func(endValue time.Duration) *subtitle.SubtitleEntry {
-		se.EndValue = endValue
-		samiState = SamiStateInit
+	// closeSeAndAdvance resolves the entry under construction (se) against
+	// the pending table for its class, then hands back a fresh, empty se
+	// ready for the next P.
+	closeSeAndAdvance := func() {
+		class := se.Class
+		if class == "" {
+			class = defaultSamiClass
+		}
+
+		if seIsBlank {
+			if open, ok := pending[class]; ok {
+				open.EndValue = se.StartValue
+				entries = append(entries, *open)
+				delete(pending, class)
+			}
+		} else if seStarted {
+			if open, ok := pending[class]; ok {
+				open.EndValue = se.StartValue
+				entries = append(entries, *open)
+			}
+			pending[class] = se
+		}
 
-		st.Subtitles = append(st.Subtitles, *se)
-		return new(subtitle.SubtitleEntry)
+		se = new(subtitle.SubtitleEntry)
+		seStarted = false
+		seIsBlank = false
 	}
 
+	var rawTextErr error
+
 	parseStartTagToken := func(z *html.Tokenizer) bool {
 		tn, hasAttr := z.TagName()
 		tnStr := string(tn)
 
+		if lower := strings.ToLower(tnStr); samiRawTextTags[lower] {
+			raw, err := readSamiRawTextElement(z, lower)
+			if err != nil {
+				rawTextErr = err
+				return true
+			}
+			if lower == "style" {
+				sr.RawStyle = raw
+				sr.Styles = parseSamiStyles(raw)
+			}
+			return true
+		}
+
 		if hasAttr && strings.ToLower(tnStr) == "sync" {
 			key, value, _ := z.TagAttr()
 			if strings.ToLower(string(key)) == "start" {
-				if samiState == SamiStateSyncEnd {
-					se = storeGetNewSubEntry(prevStartValue)
-					// fall through the SamiStateInit case below
+				startValue, err := samiParseTimestamp(sr, inputData, z, string(value))
+				if err != nil {
+					rawTextErr = err
+					return true
 				}
+				currentTs = startValue
+				return true
+			}
+		}
+
+		if strings.ToLower(tnStr) == "p" {
+			closeSeAndAdvance()
+			se.StartValue = currentTs
 
-				if samiState == SamiStateInit {
-					se.StartValue = pkg.ComposeTimeDuration(0, 0, 0, pkg.StringToInt(string(value)))
-					prevStartValue = se.StartValue
-					samiState = SamiStateSyncStart
-				} else if samiState == SamiStateSyncStart || samiState == SamiStateText {
-					se = storeGetNewSubEntry(pkg.ComposeTimeDuration(0, 0, 0, pkg.StringToInt(string(value))))
+			for {
+				key, value, moreAttr := z.TagAttr()
+				if strings.ToLower(string(key)) == "class" {
+					// Normalize once here so this matches the keys
+					// Styles is parsed into (parseSamiStyles uppercases
+					// className too), regardless of how the P Class
+					// attribute happens to be cased in the source file.
+					se.Class = strings.ToUpper(string(value))
 				}
+				if !moreAttr {
+					break
+				}
+			}
+
+			class := se.Class
+			if class == "" {
+				class = defaultSamiClass
+			}
+			if last, ok := lastStartByClass[class]; ok && se.StartValue < last {
+				rawTextErr = fmt.Errorf("sami: non-monotonic Start value for class %s at byte offset %d", class, samiByteOffset(inputData, z))
 				return true
 			}
+			lastStartByClass[class] = se.StartValue
+
+			return false
 		}
 
 		// consider this node as a text node with an in-text tag
@@ -132,6 +391,10 @@ func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
 	}
 
 	parseTextToken := func(z *html.Tokenizer) {
+		if seStarted || seIsBlank {
+			return
+		}
+
 		toSyncEnd := false
 		parsed := ""
 
@@ -142,19 +405,19 @@ func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
 			parsed = string(z.Text())
 		}
 
-		if samiState == SamiStateSyncStart || samiState == SamiStateInit {
-			textStr := stripComments(parsed)
+		textStr := stripComments(parsed)
+
+		inText := strings.TrimSpace(renl.ReplaceAllString(textStr, " "))
+		if len(inText) == 0 {
+			return
+		}
 
-			inText := strings.TrimSpace(renl.ReplaceAllString(textStr, " "))
-			if len(inText) > 0 {
-				se.Text += parsed
+		se.Text += parsed
 
-				if toSyncEnd {
-					samiState = SamiStateSyncEnd
-				} else {
-					samiState = SamiStateText
-				}
-			}
+		if toSyncEnd {
+			seIsBlank = true
+		} else {
+			seStarted = true
 		}
 	}
 
@@ -167,7 +430,7 @@ func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
 			if z.Err() == io.EOF {
 				break
 			}
-			return subtitle.Subtitle{}, fmt.Errorf("got error token")
+			return nil, fmt.Errorf("got error token")
 		case html.StartTagToken:
 			if toBreak := parseStartTagToken(z); toBreak {
 				break
@@ -180,50 +443,163 @@ func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
 			// do nothing
 		}
 
+		if rawTextErr != nil {
+			return nil, rawTextErr
+		}
+
 		if z.Err() == io.EOF {
 			break
 		}
 	}
 
-	return st, nil
+	// Flush whatever the last P left behind: a trailing &nbsp; still
+	// closes out its class's open entry, same as it would mid-document.
+	closeSeAndAdvance()
+
+	// A class that's still open at EOF (the document ended without an
+	// explicit trailing &nbsp;) would otherwise be silently dropped.
+	// Close it out at the last timestamp seen rather than lose it.
+	if len(pending) > 0 {
+		classes := make([]string, 0, len(pending))
+		for class := range pending {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			open := pending[class]
+			open.EndValue = currentTs
+			entries = append(entries, *open)
+		}
+	}
+
+	return entries, nil
+}
+
+// Read parses a single SAMI document into one flat timeline spanning every
+// P Class found in it, in the order parseSamiEntries closes the entries
+// (document order within each class). Use ReadTracks instead to
+// pull out the entries of just one language track.
+func (sr *SamiFormat) Read(inputData string) (subtitle.Subtitle, error) {
+	entries, err := sr.parseSamiEntries(inputData)
+	if err != nil {
+		return subtitle.Subtitle{}, err
+	}
+	return subtitle.Subtitle{Subtitles: entries}, nil
+}
+
+// ReadTracks parses a SAMI document and groups its entries by P Class, so
+// callers can pull out a single language track, e.g. tracks["KRCC"]. Entries
+// without an explicit Class are grouped under defaultSamiClass.
+func (sr *SamiFormat) ReadTracks(inputData string) (map[string]subtitle.Subtitle, error) {
+	entries, err := sr.parseSamiEntries(inputData)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make(map[string]subtitle.Subtitle)
+	for _, e := range entries {
+		class := e.Class
+		if class == "" {
+			class = defaultSamiClass
+		}
+		t := tracks[class]
+		t.Subtitles = append(t.Subtitles, e)
+		tracks[class] = t
+	}
+
+	return tracks, nil
 }
 
+// Write renders a single flat timeline back into a SAMI document, tagging
+// each entry's <P> with its Class (or defaultSamiClass if unset).
 func (sr *SamiFormat) Write(insub subtitle.Subtitle) (string, error) {
+	tracks := make(map[string]subtitle.Subtitle)
+	for _, v := range insub.Subtitles {
+		class := v.Class
+		if class == "" {
+			class = defaultSamiClass
+		}
+		t := tracks[class]
+		t.Subtitles = append(t.Subtitles, v)
+		tracks[class] = t
+	}
+
+	return sr.WriteTracks(tracks)
+}
+
+// samiTrackPoint is one language's contribution to a merged SYNC timestamp:
+// either the start of an entry's display (its text) or the end of one
+// (a blank "&nbsp;" marker).
+type samiTrackPoint struct {
+	class string
+	text  string
+}
+
+// WriteTracks merges any number of per-language tracks into a single sorted
+// SAMI timeline, emitting one <SYNC> per unique timestamp across all tracks
+// and one <P Class=XXCC> child per language present at that timestamp.
+func (sr *SamiFormat) WriteTracks(tracks map[string]subtitle.Subtitle) (string, error) {
+	classNames := make([]string, 0, len(tracks))
+	for class := range tracks {
+		classNames = append(classNames, class)
+	}
+	sort.Strings(classNames)
+
+	timeline := make(map[time.Duration][]samiTrackPoint)
+	for _, class := range classNames {
+		// An entry that ends exactly where another entry of the same class
+		// starts gets no &nbsp; marker: the next entry's own P closes it.
+		starts := make(map[time.Duration]bool)
+		for _, v := range tracks[class].Subtitles {
+			starts[v.StartValue] = true
+		}
+		for _, v := range tracks[class].Subtitles {
+			htmlText := strings.TrimSpace(html.UnescapeString(v.Text))
+			timeline[v.StartValue] = append(timeline[v.StartValue], samiTrackPoint{
+				class: class,
+				text:  fmt.Sprintf("%s\n", htmlText),
+			})
+			if starts[v.EndValue] && v.EndValue != v.StartValue {
+				continue
+			}
+			timeline[v.EndValue] = append(timeline[v.EndValue], samiTrackPoint{
+				class: class,
+				text:  "&nbsp;\n",
+			})
+		}
+	}
+
+	timestamps := make([]time.Duration, 0, len(timeline))
+	for ts := range timeline {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
 	doc := &html.Node{
 		Type: html.DocumentNode,
 	}
-	for _, v := range insub.Subtitles {
-		htmlText := strings.TrimSpace(html.UnescapeString(v.Text))
 
-		sStartNode := &html.Node{
-			Type: html.ElementNode,
-			Data: fmt.Sprintf("SYNC Start=%s", timeToSami(v.StartValue)),
-		}
-		sPNode := &html.Node{
-			Type: html.ElementNode,
-			Data: "P Class=ENCC",
-		}
-		sPNode.AppendChild(&html.Node{
-			Type: html.TextNode,
-			Data: fmt.Sprintf("%s\n", htmlText),
-		})
-		sStartNode.AppendChild(sPNode)
-		doc.AppendChild(sStartNode)
+	if len(sr.Styles) > 0 {
+		doc.AppendChild(sr.buildStyleNode())
+	}
 
-		sEndNode := &html.Node{
+	for _, ts := range timestamps {
+		syncNode := &html.Node{
 			Type: html.ElementNode,
-			Data: fmt.Sprintf("SYNC Start=%s", timeToSami(v.EndValue)),
+			Data: fmt.Sprintf("SYNC Start=%s", samiFormatTimestamp(sr, ts)),
 		}
-		sPNode = &html.Node{
-			Type: html.ElementNode,
-			Data: "P Class=ENCC",
+		for _, p := range timeline[ts] {
+			pNode := &html.Node{
+				Type: html.ElementNode,
+				Data: fmt.Sprintf("P Class=%s", p.class),
+			}
+			pNode.AppendChild(&html.Node{
+				Type: html.TextNode,
+				Data: p.text,
+			})
+			syncNode.AppendChild(pNode)
 		}
-		sPNode.AppendChild(&html.Node{
-			Type: html.TextNode,
-			Data: "&nbsp;\n",
-		})
-		sEndNode.AppendChild(sPNode)
-		doc.AppendChild(sEndNode)
+		doc.AppendChild(syncNode)
 	}
 
 	b := new(bytes.Buffer)
@@ -253,10 +629,41 @@ func stripComments(inStr string) string {
 	return inStr
 }
 
-func timeToSami(inTime time.Duration) string {
-	totalSec := inTime.Seconds()
-	totalMsec := (int(totalSec) * 1000) + int(inTime.Nanoseconds()/1000/1000%1000)
-	return fmt.Sprintf("%d", totalMsec)
+// timeBase returns sr.TimeBase, defaulting to time.Millisecond per the SAMI
+// spec when it hasn't been set.
+func (sr *SamiFormat) timeBase() time.Duration {
+	if sr.TimeBase <= 0 {
+		return time.Millisecond
+	}
+	return sr.TimeBase
+}
+
+// samiByteOffset approximates how many bytes of inputData the tokenizer has
+// consumed so far, for inclusion in parse error messages.
+func samiByteOffset(inputData string, z *html.Tokenizer) int {
+	return len(inputData) - len(z.Buffered())
+}
+
+// samiParseTimestamp parses a SYNC Start attribute as an integer count of
+// sr.TimeBase units (whole milliseconds by default, per the SAMI spec),
+// converting it to a time.Duration without losing precision. It rejects
+// values that aren't a plain integer or that are negative.
+func samiParseTimestamp(sr *SamiFormat, inputData string, z *html.Tokenizer, value string) (time.Duration, error) {
+	raw, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sami: invalid Start value %q at byte offset %d: %w", value, samiByteOffset(inputData, z), err)
+	}
+	if raw < 0 {
+		return 0, fmt.Errorf("sami: negative Start value %q at byte offset %d", value, samiByteOffset(inputData, z))
+	}
+
+	return time.Duration(raw) * sr.timeBase(), nil
+}
+
+// samiFormatTimestamp is the inverse of samiParseTimestamp: it renders a
+// time.Duration as a plain integer count of sr.TimeBase units.
+func samiFormatTimestamp(sr *SamiFormat, d time.Duration) string {
+	return fmt.Sprintf("%d", d/sr.timeBase())
 }
 
 // The parts below maily came from golang.org/x/net/html.
@@ -414,8 +821,8 @@ func doSamiRender(w samiWriter, n *html.Node) error {
 	}
 
 	// Render any child nodes.
-	switch n.Data {
-	case "iframe", "noembed", "noframes", "noscript", "plaintext", "script", "style", "xmp":
+	switch {
+	case isRawTextTag(n.Data):
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
 			if c.Type == html.TextNode {
 				if _, err := w.WriteString(c.Data); err != nil {
@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Dongsu Park <dpark@posteo.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package parser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadStyleBlockWithCommentsMediaAndFontFace(t *testing.T) {
+	const doc = `<SAMI>
+<HEAD>
+<STYLE TYPE="text/css">
+<!--
+/* base styles, plus a sneaky "</p>"-looking comment below */
+P { font-family: Arial; }
+/* this looks like a closing P tag but must not break tokenizing: </P> */
+.ENCC { lang: en-US; name: English; }
+.KRCC { lang: ko-KR; name: Korean; text-align: center; }
+@font-face {
+	font-family: "SamiSans";
+	src: url(sami-sans.woff2) format("woff2");
+}
+@media screen and (max-width: 480px) {
+	.ENCC { font-size: 12pt; }
+}
+-->
+</STYLE>
+</HEAD>
+<BODY>
+<SYNC Start=1000><P Class=ENCC>Hello there
+<SYNC Start=4000><P Class=ENCC>&nbsp;
+</BODY>
+</SAMI>`
+
+	sf := &SamiFormat{}
+	sub, err := sf.Read(doc)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(sub.Subtitles) != 1 {
+		t.Fatalf("got %d entries, want 1: %+v", len(sub.Subtitles), sub.Subtitles)
+	}
+	if got, want := sub.Subtitles[0].Text, "Hello there\n"; got != want {
+		t.Errorf("entry text = %q, want %q", got, want)
+	}
+
+	// The raw-text tokenizer must swallow the whole block as opaque text,
+	// including the @font-face/@media rules and the stray </P>-looking
+	// comment, rather than leaking any of it into the entry stream above.
+	if !strings.Contains(sf.RawStyle, "@font-face") || !strings.Contains(sf.RawStyle, "@media") {
+		t.Errorf("RawStyle lost the @font-face/@media rules: %q", sf.RawStyle)
+	}
+	if !strings.Contains(sf.RawStyle, "</P>") {
+		t.Errorf("RawStyle lost the stray </P>-looking comment text: %q", sf.RawStyle)
+	}
+
+	wantStyles := map[string]SamiStyle{
+		"ENCC": {Lang: "en-US", Name: "English"},
+		"KRCC": {Lang: "ko-KR", Name: "Korean", Alignment: "center"},
+	}
+	if len(sf.Styles) != len(wantStyles) {
+		t.Fatalf("got %d Styles, want %d: %+v", len(sf.Styles), len(wantStyles), sf.Styles)
+	}
+	for class, want := range wantStyles {
+		got, ok := sf.Styles[class]
+		if !ok {
+			t.Errorf("missing Styles[%q]", class)
+			continue
+		}
+		if got.Lang != want.Lang || got.Name != want.Name || got.Alignment != want.Alignment {
+			t.Errorf("Styles[%q] = %+v, want %+v", class, *got, want)
+		}
+	}
+}
+
+func TestReadTracksGroupsByClassAndWriteTracksRoundTrips(t *testing.T) {
+	const doc = `<SAMI>
+<HEAD>
+<STYLE TYPE="text/css">
+.ENCC { lang: en-US; name: English; }
+.KRCC { lang: ko-KR; name: Korean; }
+</STYLE>
+</HEAD>
+<BODY>
+<SYNC Start=1000><P Class=ENCC>Hello there
+<P Class=KRCC>Annyeong
+<SYNC Start=4000><P Class=ENCC>&nbsp;
+<P Class=KRCC>&nbsp;
+<SYNC Start=5000><P Class=ENCC>Goodbye
+<SYNC Start=7000><P Class=ENCC>&nbsp;
+</BODY>
+</SAMI>`
+
+	sf := &SamiFormat{}
+	tracks, err := sf.ReadTracks(doc)
+	if err != nil {
+		t.Fatalf("ReadTracks: %v", err)
+	}
+
+	wantCounts := map[string]int{"ENCC": 2, "KRCC": 1}
+	for class, want := range wantCounts {
+		got, ok := tracks[class]
+		if !ok {
+			t.Fatalf("missing track %q", class)
+		}
+		if len(got.Subtitles) != want {
+			t.Errorf("track %q has %d entries, want %d: %+v", class, len(got.Subtitles), want, got.Subtitles)
+		}
+	}
+
+	// WriteTracks merges both tracks under shared SYNC timestamps (t=1000
+	// and t=4000 are shared), which is exactly the shape parseSamiEntries
+	// has to disentangle again: multiple P's under one SYNC.
+	out, err := sf.WriteTracks(tracks)
+	if err != nil {
+		t.Fatalf("WriteTracks: %v", err)
+	}
+
+	sf2 := &SamiFormat{}
+	tracks2, err := sf2.ReadTracks(out)
+	if err != nil {
+		t.Fatalf("re-ReadTracks: %v\noutput:\n%s", err, out)
+	}
+
+	if len(tracks2) != len(tracks) {
+		t.Fatalf("re-read %d tracks, want %d\noutput:\n%s", len(tracks2), len(tracks), out)
+	}
+	for class, want := range tracks {
+		got, ok := tracks2[class]
+		if !ok {
+			t.Fatalf("re-read is missing track %q\noutput:\n%s", class, out)
+		}
+		if len(got.Subtitles) != len(want.Subtitles) {
+			t.Fatalf("re-read track %q has %d entries, want %d\noutput:\n%s", class, len(got.Subtitles), len(want.Subtitles), out)
+		}
+		for i := range want.Subtitles {
+			if got.Subtitles[i] != want.Subtitles[i] {
+				t.Errorf("re-read track %q entry %d = %+v, want %+v", class, i, got.Subtitles[i], want.Subtitles[i])
+			}
+		}
+	}
+}
+
+func TestSamiParseTimestampRejectsNegativeAndNonMonotonic(t *testing.T) {
+	sf := &SamiFormat{}
+
+	if _, err := sf.Read(`<SYNC Start=-100><P Class=ENCC>a`); err == nil {
+		t.Error("Read with a negative Start value: got nil error, want one")
+	}
+
+	if _, err := sf.Read(`<SYNC Start=5000><P Class=ENCC>a<SYNC Start=1000><P Class=ENCC>b`); err == nil {
+		t.Error("Read with a non-monotonic Start value: got nil error, want one")
+	}
+}
+
+func TestSamiFormatTimeBaseDefaultsToMilliseconds(t *testing.T) {
+	sf := &SamiFormat{}
+	sub, err := sf.Read(`<SYNC Start=1500><P Class=ENCC>hi<SYNC Start=3000><P Class=ENCC>&nbsp;`)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got, want := sub.Subtitles[0].StartValue, 1500*time.Millisecond; got != want {
+		t.Errorf("StartValue = %v, want %v", got, want)
+	}
+}
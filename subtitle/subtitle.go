@@ -0,0 +1,36 @@
+// Copyright (c) 2017 Dongsu Park <dpark@posteo.net>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+// Package subtitle defines the format-independent data types shared by all
+// subtitle parsers in this repository.
+package subtitle
+
+import "time"
+
+// SubtitleEntry is a single timed caption, as produced or consumed by any
+// of the format-specific parsers.
+type SubtitleEntry struct {
+	StartValue time.Duration
+	EndValue   time.Duration
+	Text       string
+
+	// Class is an optional format-specific style or track identifier,
+	// e.g. the P Class of a SAMI entry.
+	Class string
+}
+
+// Subtitle is an ordered collection of subtitle entries.
+type Subtitle struct {
+	Subtitles []SubtitleEntry
+}